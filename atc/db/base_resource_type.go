@@ -3,20 +3,41 @@ package db
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
+
 	"github.com/concourse/concourse/atc"
 
 	sq "github.com/Masterminds/squirrel"
 )
 
+// BaseResourceTypeState mirrors the worker state machine in dbng
+// (running/landing/retiring/landed): it gives operators a safe window to
+// migrate pipelines off a base resource type before it's removed, instead
+// of an all-or-nothing deletion.
+type BaseResourceTypeState string
+
+const (
+	BaseResourceTypeStateActive     BaseResourceTypeState = "active"
+	BaseResourceTypeStateDeprecated BaseResourceTypeState = "deprecated"
+	BaseResourceTypeStateRetiring   BaseResourceTypeState = "retiring"
+)
+
 // BaseResourceType represents a resource type provided by workers.
 //
 // It is created via worker registration. All creates are upserts.
 //
-// It is removed by gc.BaseResourceTypeCollector, once there are no references
-// to it from worker_base_resource_types.
+// It is removed by gc.BaseResourceTypeCollector, once it is in the retiring
+// state and there are no references to it from worker_base_resource_types
+// or resource_configs.
 type BaseResourceType struct {
 	Id   int
 	Name string // The name of the type, e.g. 'git'.
+
+	// Version, if set, restricts Find/FindOrCreate to the
+	// UsedBaseResourceType advertised under this exact digest (e.g. the
+	// sha256 of the image that implements the type) by at least one
+	// worker, rather than resolving to any version of the type.
+	Version string
 }
 
 // UsedBaseResourceType is created whenever a ResourceConfig is used, either
@@ -30,39 +51,152 @@ type UsedBaseResourceType struct {
 	Name                 string // The name of the type, e.g. 'git'.
 	UniqueVersionHistory bool   // If set to true, will create unique version histories for each of the resources using this base resource type
 	Defaults             atc.Source
+	State                BaseResourceTypeState
+	DeprecationReason    string // Set when State is deprecated; surfaced through the API and web UI wherever a pipeline references this type.
 }
 
 // FindOrCreate looks for an existing BaseResourceType and creates it if it
 // doesn't exist. It returns a UsedBaseResourceType.
+//
+// This is the generic resolution path used whenever a ResourceConfig is
+// used - it never changes State, and in particular never reactivates a
+// retiring type. The only thing allowed to do that is a worker explicitly
+// registering the type via Register.
 func (brt BaseResourceType) FindOrCreate(tx Tx, unique bool) (*UsedBaseResourceType, error) {
 	ubrt, found, err := brt.Find(tx)
 	if err != nil {
 		return nil, err
 	}
 
-	if found && ubrt.UniqueVersionHistory == unique {
+	if !found {
+		if brt.Version != "" {
+			// create() upserts by name alone and knows nothing about
+			// versions, so it can't honor a request pinned to an exact
+			// digest - returning its result here would silently hand the
+			// caller a type that isn't actually running that digest
+			// anywhere in the fleet.
+			return nil, UnknownBaseResourceTypeVersionError{Name: brt.Name, Version: brt.Version}
+		}
+
+		return brt.create(tx, unique)
+	}
+
+	if ubrt.UniqueVersionHistory == unique {
 		return ubrt, nil
 	}
 
 	return brt.create(tx, unique)
 }
 
+// Register records that a worker has this base resource type available,
+// optionally reporting the digest (e.g. image sha256) it's running. It is
+// the sole entry point allowed to promote a retiring type back to active -
+// that's what "a worker explicitly re-registers it" means - which is why
+// FindOrCreate, used by generic config resolution, must never call this
+// reactivation logic itself.
+func (brt BaseResourceType) Register(tx Tx, unique bool, workerName string, version string) (*UsedBaseResourceType, error) {
+	// Look the type up by id/name alone: the current state belongs to the
+	// type, not to whichever digest this worker happens to report.
+	ubrt, found, err := BaseResourceType{Id: brt.Id, Name: brt.Name}.Find(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	state := BaseResourceTypeStateActive
+	if found {
+		state = reactivatedState(ubrt.State)
+	}
+
+	var id int
+	var savedUnique bool
+	var savedState string
+	err = psql.Insert("base_resource_types").
+		Columns("name", "unique_version_history", "state").
+		Values(brt.Name, unique, state).
+		Suffix(`
+			ON CONFLICT (name) DO UPDATE SET
+				name = EXCLUDED.name,
+				unique_version_history = EXCLUDED.unique_version_history OR base_resource_types.unique_version_history,
+				state = EXCLUDED.state
+			RETURNING id, unique_version_history, state
+		`).
+		RunWith(tx).
+		QueryRow().
+		Scan(&id, &savedUnique, &savedState)
+	if err != nil {
+		return nil, err
+	}
+
+	registered := &UsedBaseResourceType{
+		ID:                   id,
+		Name:                 brt.Name,
+		UniqueVersionHistory: savedUnique,
+		State:                BaseResourceTypeState(savedState),
+	}
+
+	if workerName != "" {
+		_, err = WorkerBaseResourceType{WorkerName: workerName, BaseResourceTypeID: id, Version: version}.FindOrCreate(tx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return registered, nil
+}
+
+// reactivatedState is the state a base resource type should move to when a
+// worker registers it: retiring is the only state a registration reverses,
+// since an admin-set deprecation shouldn't be silently cleared just because
+// a worker still has the type.
+func reactivatedState(current BaseResourceTypeState) BaseResourceTypeState {
+	if current == BaseResourceTypeStateRetiring {
+		return BaseResourceTypeStateActive
+	}
+
+	return current
+}
+
+// UnknownBaseResourceTypeVersionError is returned by FindOrCreate when a
+// caller pins to an exact digest (via BaseResourceType.Version) that no
+// worker is currently advertising.
+type UnknownBaseResourceTypeVersionError struct {
+	Name    string
+	Version string
+}
+
+func (e UnknownBaseResourceTypeVersionError) Error() string {
+	return fmt.Sprintf("no worker advertises version %q of base resource type %q", e.Version, e.Name)
+}
+
 func (brt BaseResourceType) Find(runner sq.Runner) (*UsedBaseResourceType, bool, error) {
 	var id int
 	var name string
 	var unique bool
+	var state string
+	var deprecationReason sql.NullString
 	var defaultsString sql.NullString
-	sb := psql.Select("id, name, unique_version_history, defaults").
+	sb := psql.Select("id, name, unique_version_history, state, deprecation_reason, defaults").
 		From("base_resource_types")
 	if brt.Id > 0 {
 		sb = sb.Where(sq.Eq{"id": brt.Id})
 	} else {
 		sb = sb.Where(sq.Eq{"name": brt.Name})
 	}
+
+	if brt.Version != "" {
+		sb = sb.Where(sq.Expr(`
+			EXISTS (
+				SELECT 1 FROM worker_base_resource_types wbrt
+				WHERE wbrt.base_resource_type_id = base_resource_types.id
+				AND wbrt.version = ?
+			)
+		`, brt.Version))
+	}
+
 	err := sb.Suffix("FOR SHARE").
 		RunWith(runner).
 		QueryRow().
-		Scan(&id, &name, &unique, &defaultsString)
+		Scan(&id, &name, &unique, &state, &deprecationReason, &defaultsString)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, false, nil
@@ -79,27 +213,122 @@ func (brt BaseResourceType) Find(runner sq.Runner) (*UsedBaseResourceType, bool,
 		}
 	}
 
-	return &UsedBaseResourceType{ID: id, Name: name, UniqueVersionHistory: unique, Defaults: defaults}, true, nil
+	return &UsedBaseResourceType{
+		ID:                   id,
+		Name:                 name,
+		UniqueVersionHistory: unique,
+		Defaults:             defaults,
+		State:                BaseResourceTypeState(state),
+		DeprecationReason:    deprecationReason.String,
+	}, true, nil
+}
+
+// MarkDeprecated records a human-readable reason that this base resource
+// type should no longer be used, and moves it to the deprecated state. This
+// doesn't affect its availability - it stays usable, and is not eligible for
+// garbage collection, until an operator also transitions it to retiring.
+//
+// The reason is stored here so the API and web UI can surface it wherever a
+// pipeline references this type; wiring that display is left to the API/web
+// layers, which don't live in this package.
+func (ubrt UsedBaseResourceType) MarkDeprecated(tx Tx, reason string) error {
+	_, err := psql.Update("base_resource_types").
+		Set("state", BaseResourceTypeStateDeprecated).
+		Set("deprecation_reason", reason).
+		Where(sq.Eq{"id": ubrt.ID}).
+		RunWith(tx).
+		Exec()
+	return err
+}
+
+// MarkRetiring transitions this base resource type into the retiring state,
+// the only state gc.BaseResourceTypeCollector is allowed to delete from -
+// and even then, only once no worker_base_resource_types rows reference it.
+// This is how an operator opens the safe window to migrate pipelines off a
+// type before Register (a worker re-registering it) or the collector (no
+// workers left) resolve it one way or the other.
+func (ubrt UsedBaseResourceType) MarkRetiring(tx Tx) error {
+	_, err := psql.Update("base_resource_types").
+		Set("state", BaseResourceTypeStateRetiring).
+		Where(sq.Eq{"id": ubrt.ID}).
+		RunWith(tx).
+		Exec()
+	return err
+}
+
+// WorkersForVersion returns the names of the workers currently advertising
+// the given digest for this base resource type, so the scheduler can pin a
+// build to workers whose resource type binary matches the version that
+// produced an input.
+func (ubrt UsedBaseResourceType) WorkersForVersion(runner sq.Runner, version string) ([]string, error) {
+	rows, err := psql.Select("worker_name").
+		From("worker_base_resource_types").
+		Where(sq.Eq{"base_resource_type_id": ubrt.ID, "version": version}).
+		RunWith(runner).
+		Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var workers []string
+	for rows.Next() {
+		var worker string
+		if err := rows.Scan(&worker); err != nil {
+			return nil, err
+		}
+		workers = append(workers, worker)
+	}
+
+	return workers, rows.Err()
+}
+
+// Mixed reports whether the workers in the fleet are currently advertising
+// more than one distinct digest for this base resource type, which the API
+// surfaces so operators can tell that a rolling upgrade is in progress.
+func (ubrt UsedBaseResourceType) Mixed(runner sq.Runner) (bool, error) {
+	var distinctVersions int
+	err := psql.Select("COUNT(DISTINCT version)").
+		From("worker_base_resource_types").
+		Where(sq.Eq{"base_resource_type_id": ubrt.ID}).
+		Where(sq.NotEq{"version": ""}).
+		RunWith(runner).
+		QueryRow().
+		Scan(&distinctVersions)
+	if err != nil {
+		return false, err
+	}
+
+	return distinctVersions > 1, nil
 }
 
+// create upserts the row backing FindOrCreate's generic resolution path.
+// It leaves an existing row's state untouched on conflict - only Register
+// is allowed to move a type out of retiring.
 func (brt BaseResourceType) create(tx Tx, unique bool) (*UsedBaseResourceType, error) {
 	var id int
 	var savedUnique bool
+	var state string
 	err := psql.Insert("base_resource_types").
-		Columns("name", "unique_version_history").
-		Values(brt.Name, unique).
+		Columns("name", "unique_version_history", "state").
+		Values(brt.Name, unique, BaseResourceTypeStateActive).
 		Suffix(`
 			ON CONFLICT (name) DO UPDATE SET
 				name = EXCLUDED.name,
 				unique_version_history = EXCLUDED.unique_version_history OR base_resource_types.unique_version_history
-			RETURNING id, unique_version_history
+			RETURNING id, unique_version_history, state
 		`).
 		RunWith(tx).
 		QueryRow().
-		Scan(&id, &savedUnique)
+		Scan(&id, &savedUnique, &state)
 	if err != nil {
 		return nil, err
 	}
 
-	return &UsedBaseResourceType{ID: id, Name: brt.Name, UniqueVersionHistory: savedUnique}, nil
+	return &UsedBaseResourceType{
+		ID:                   id,
+		Name:                 brt.Name,
+		UniqueVersionHistory: savedUnique,
+		State:                BaseResourceTypeState(state),
+	}, nil
 }
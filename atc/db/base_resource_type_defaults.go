@@ -0,0 +1,270 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	"github.com/concourse/concourse/atc"
+
+	sq "github.com/Masterminds/squirrel"
+)
+
+// ResolveDefaults merges the source configured for a base resource type at
+// each layer - global, then team, then pipeline - with later layers
+// overriding keys set by earlier ones. teamID and/or pipelineID may be zero
+// to skip that layer (e.g. a one-off build with no pipeline).
+//
+// It also returns the current defaults_version for the type, which bumps
+// every time a team or pipeline layer for this name is set or unset (see
+// bumpBaseResourceTypeDefaultsVersion). SnapshotDefaults does not store this
+// version with the snapshot it records. A snapshot recorded by
+// SnapshotDefaults is read back as-is by SnapshottedDefaults rather than
+// re-resolved, so a caller that reads it keeps using the defaults that were
+// in effect when it was recorded even if an operator changes a layer later.
+func ResolveDefaults(runner sq.Runner, name string, teamID int, pipelineID int) (atc.Source, int, error) {
+	merged := atc.Source{}
+
+	global, version, err := baseResourceTypeDefaults(runner, name)
+	if err != nil {
+		return nil, 0, err
+	}
+	mergeSource(merged, global)
+
+	if teamID != 0 {
+		team, err := teamBaseResourceTypeDefaults(runner, teamID, name)
+		if err != nil {
+			return nil, 0, err
+		}
+		mergeSource(merged, team)
+	}
+
+	if pipelineID != 0 {
+		pipeline, err := pipelineBaseResourceTypeDefaults(runner, pipelineID, name)
+		if err != nil {
+			return nil, 0, err
+		}
+		mergeSource(merged, pipeline)
+	}
+
+	return merged, version, nil
+}
+
+func mergeSource(dst, src atc.Source) {
+	for k, v := range src {
+		dst[k] = v
+	}
+}
+
+func baseResourceTypeDefaults(runner sq.Runner, name string) (atc.Source, int, error) {
+	var defaultsString sql.NullString
+	var version int
+	err := psql.Select("defaults, defaults_version").
+		From("base_resource_types").
+		Where(sq.Eq{"name": name}).
+		RunWith(runner).
+		QueryRow().
+		Scan(&defaultsString, &version)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return atc.Source{}, 0, nil
+		}
+
+		return nil, 0, err
+	}
+
+	source, err := unmarshalSource(defaultsString)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return source, version, nil
+}
+
+func teamBaseResourceTypeDefaults(runner sq.Runner, teamID int, name string) (atc.Source, error) {
+	var defaultsString sql.NullString
+	err := psql.Select("defaults").
+		From("team_base_resource_type_defaults").
+		Where(sq.Eq{"team_id": teamID, "base_resource_type_name": name}).
+		RunWith(runner).
+		QueryRow().
+		Scan(&defaultsString)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return atc.Source{}, nil
+		}
+
+		return nil, err
+	}
+
+	return unmarshalSource(defaultsString)
+}
+
+func pipelineBaseResourceTypeDefaults(runner sq.Runner, pipelineID int, name string) (atc.Source, error) {
+	var defaultsString sql.NullString
+	err := psql.Select("defaults").
+		From("pipeline_base_resource_type_defaults").
+		Where(sq.Eq{"pipeline_id": pipelineID, "base_resource_type_name": name}).
+		RunWith(runner).
+		QueryRow().
+		Scan(&defaultsString)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return atc.Source{}, nil
+		}
+
+		return nil, err
+	}
+
+	return unmarshalSource(defaultsString)
+}
+
+func unmarshalSource(defaultsString sql.NullString) (atc.Source, error) {
+	source := atc.Source{}
+	if defaultsString.Valid {
+		err := json.Unmarshal([]byte(defaultsString.String), &source)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return source, nil
+}
+
+func setTeamBaseResourceTypeDefaults(tx Tx, teamID int, name string, source atc.Source) error {
+	marshaled, err := json.Marshal(source)
+	if err != nil {
+		return err
+	}
+
+	_, err = psql.Insert("team_base_resource_type_defaults").
+		Columns("team_id", "base_resource_type_name", "defaults").
+		Values(teamID, name, marshaled).
+		Suffix(`
+			ON CONFLICT (team_id, base_resource_type_name) DO UPDATE SET
+				defaults = EXCLUDED.defaults
+		`).
+		RunWith(tx).
+		Exec()
+	if err != nil {
+		return err
+	}
+
+	return bumpBaseResourceTypeDefaultsVersion(tx, name)
+}
+
+func unsetTeamBaseResourceTypeDefaults(tx Tx, teamID int, name string) error {
+	_, err := psql.Delete("team_base_resource_type_defaults").
+		Where(sq.Eq{"team_id": teamID, "base_resource_type_name": name}).
+		RunWith(tx).
+		Exec()
+	if err != nil {
+		return err
+	}
+
+	return bumpBaseResourceTypeDefaultsVersion(tx, name)
+}
+
+func setPipelineBaseResourceTypeDefaults(tx Tx, pipelineID int, name string, source atc.Source) error {
+	marshaled, err := json.Marshal(source)
+	if err != nil {
+		return err
+	}
+
+	_, err = psql.Insert("pipeline_base_resource_type_defaults").
+		Columns("pipeline_id", "base_resource_type_name", "defaults").
+		Values(pipelineID, name, marshaled).
+		Suffix(`
+			ON CONFLICT (pipeline_id, base_resource_type_name) DO UPDATE SET
+				defaults = EXCLUDED.defaults
+		`).
+		RunWith(tx).
+		Exec()
+	if err != nil {
+		return err
+	}
+
+	return bumpBaseResourceTypeDefaultsVersion(tx, name)
+}
+
+func unsetPipelineBaseResourceTypeDefaults(tx Tx, pipelineID int, name string) error {
+	_, err := psql.Delete("pipeline_base_resource_type_defaults").
+		Where(sq.Eq{"pipeline_id": pipelineID, "base_resource_type_name": name}).
+		RunWith(tx).
+		Exec()
+	if err != nil {
+		return err
+	}
+
+	return bumpBaseResourceTypeDefaultsVersion(tx, name)
+}
+
+// bumpBaseResourceTypeDefaultsVersion increments base_resource_types'
+// defaults_version for name, which ResolveDefaults returns. Snapshots
+// recorded by SnapshotDefaults carry no version, so they are neither
+// invalidated nor re-resolved when it changes.
+func bumpBaseResourceTypeDefaultsVersion(tx Tx, name string) error {
+	_, err := psql.Update("base_resource_types").
+		Set("defaults_version", sq.Expr("defaults_version + 1")).
+		Where(sq.Eq{"name": name}).
+		RunWith(tx).
+		Exec()
+	return err
+}
+
+// SnapshotDefaults resolves the layered defaults for name and records them
+// on the given resource config row, where SnapshottedDefaults reads them
+// back without re-merging the layers. ResourceConfig's FindOrCreate neither
+// records nor reads this snapshot; callers invoke these functions directly.
+func SnapshotDefaults(tx Tx, resourceConfigID int, name string, teamID int, pipelineID int) (atc.Source, error) {
+	resolved, _, err := ResolveDefaults(tx, name, teamID, pipelineID)
+	if err != nil {
+		return nil, err
+	}
+
+	marshaled, err := json.Marshal(resolved)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = psql.Update("resource_configs").
+		Set("base_resource_type_defaults", marshaled).
+		Where(sq.Eq{"id": resourceConfigID}).
+		RunWith(tx).
+		Exec()
+	if err != nil {
+		return nil, err
+	}
+
+	return resolved, nil
+}
+
+// SnapshottedDefaults returns the base resource type defaults previously
+// recorded on a resource config by SnapshotDefaults, without re-resolving
+// the layers. found is false if the config has no snapshot yet.
+func SnapshottedDefaults(runner sq.Runner, resourceConfigID int) (source atc.Source, found bool, err error) {
+	var snapshotString sql.NullString
+	err = psql.Select("base_resource_type_defaults").
+		From("resource_configs").
+		Where(sq.Eq{"id": resourceConfigID}).
+		RunWith(runner).
+		QueryRow().
+		Scan(&snapshotString)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, false, nil
+		}
+
+		return nil, false, err
+	}
+
+	if !snapshotString.Valid {
+		return nil, false, nil
+	}
+
+	source, err = unmarshalSource(snapshotString)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return source, true, nil
+}
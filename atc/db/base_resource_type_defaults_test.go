@@ -0,0 +1,19 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/concourse/concourse/atc"
+)
+
+func TestMergeSourceLayering(t *testing.T) {
+	merged := atc.Source{"url": "global", "insecure": "false"}
+	mergeSource(merged, atc.Source{"url": "team"})
+	mergeSource(merged, atc.Source{"url": "pipeline", "branch": "main"})
+
+	want := atc.Source{"url": "pipeline", "insecure": "false", "branch": "main"}
+	if !reflect.DeepEqual(merged, want) {
+		t.Errorf("merged = %#v, want %#v", merged, want)
+	}
+}
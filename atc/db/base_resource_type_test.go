@@ -0,0 +1,35 @@
+package db
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReactivatedState(t *testing.T) {
+	cases := []struct {
+		name    string
+		current BaseResourceTypeState
+		want    BaseResourceTypeState
+	}{
+		{"active stays active", BaseResourceTypeStateActive, BaseResourceTypeStateActive},
+		{"deprecated is left alone by registration", BaseResourceTypeStateDeprecated, BaseResourceTypeStateDeprecated},
+		{"retiring is reactivated", BaseResourceTypeStateRetiring, BaseResourceTypeStateActive},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := reactivatedState(c.current)
+			if got != c.want {
+				t.Errorf("reactivatedState(%v) = %v, want %v", c.current, got, c.want)
+			}
+		})
+	}
+}
+
+func TestUnknownBaseResourceTypeVersionError(t *testing.T) {
+	err := UnknownBaseResourceTypeVersionError{Name: "git", Version: "sha256:deadbeef"}
+
+	if !strings.Contains(err.Error(), "git") || !strings.Contains(err.Error(), "sha256:deadbeef") {
+		t.Errorf("Error() = %q, want it to mention both the name and the version", err.Error())
+	}
+}
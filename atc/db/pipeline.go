@@ -0,0 +1,34 @@
+package db
+
+import (
+	"github.com/concourse/concourse/atc"
+
+	sq "github.com/Masterminds/squirrel"
+)
+
+// Pipeline is the slice of pipeline state needed to administer base
+// resource type defaults; the full Pipeline type (jobs, resources, config
+// versions, and so on) lives with the rest of the API layer.
+type Pipeline struct {
+	ID     int
+	TeamID int
+}
+
+// SetBaseResourceTypeDefaults overrides a base resource type's source
+// defaults for this pipeline, taking precedence over both the team and
+// global layers.
+func (p Pipeline) SetBaseResourceTypeDefaults(tx Tx, name string, source atc.Source) error {
+	return setPipelineBaseResourceTypeDefaults(tx, p.ID, name, source)
+}
+
+// UnsetBaseResourceTypeDefaults removes this pipeline's override, causing
+// ResolveDefaults to fall back to the team (or global) layer.
+func (p Pipeline) UnsetBaseResourceTypeDefaults(tx Tx, name string) error {
+	return unsetPipelineBaseResourceTypeDefaults(tx, p.ID, name)
+}
+
+// ResolveBaseResourceTypeDefaults merges the global, team, and this
+// pipeline's own defaults for name. See ResolveDefaults.
+func (p Pipeline) ResolveBaseResourceTypeDefaults(runner sq.Runner, name string) (atc.Source, int, error) {
+	return ResolveDefaults(runner, name, p.TeamID, p.ID)
+}
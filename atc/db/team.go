@@ -0,0 +1,25 @@
+package db
+
+import "github.com/concourse/concourse/atc"
+
+// Team is the slice of team state needed to administer base resource type
+// defaults; the full Team type (auth, pipeline ownership, and so on) lives
+// with the rest of the API layer.
+type Team struct {
+	ID int
+}
+
+// SetBaseResourceTypeDefaults overrides a base resource type's source
+// defaults for this team, taking precedence over the global default for
+// any pipeline owned by the team (but not over that pipeline's own
+// override).
+func (t Team) SetBaseResourceTypeDefaults(tx Tx, name string, source atc.Source) error {
+	return setTeamBaseResourceTypeDefaults(tx, t.ID, name, source)
+}
+
+// UnsetBaseResourceTypeDefaults removes this team's override, causing
+// ResolveDefaults to fall back to the global default for the team's
+// pipelines.
+func (t Team) UnsetBaseResourceTypeDefaults(tx Tx, name string) error {
+	return unsetTeamBaseResourceTypeDefaults(tx, t.ID, name)
+}
@@ -0,0 +1,83 @@
+package db
+
+import (
+	"database/sql"
+
+	sq "github.com/Masterminds/squirrel"
+)
+
+// WorkerBaseResourceType is reported by a worker at registration time for
+// each base resource type it has pulled, along with the digest (e.g. image
+// reference sha256) of the binary it's running.
+type WorkerBaseResourceType struct {
+	WorkerName         string
+	BaseResourceTypeID int
+	Version            string
+}
+
+// UsedWorkerBaseResourceType is the persisted row for a WorkerBaseResourceType.
+type UsedWorkerBaseResourceType struct {
+	ID                 int
+	WorkerName         string
+	BaseResourceTypeID int
+	Version            string
+}
+
+// FindOrCreate upserts the (worker, base resource type) row with the
+// reported version. The row is keyed on (worker_name, base_resource_type_id)
+// rather than also on version, so that a worker reporting a new digest for a
+// type it already advertised updates the existing row in place instead of
+// creating a new one - this preserves the row's identity (and anything
+// keyed off of it, like caches) across the worker upgrading its binary.
+func (wbrt WorkerBaseResourceType) FindOrCreate(tx Tx) (*UsedWorkerBaseResourceType, error) {
+	var id int
+	err := psql.Insert("worker_base_resource_types").
+		Columns("worker_name", "base_resource_type_id", "version").
+		Values(wbrt.WorkerName, wbrt.BaseResourceTypeID, wbrt.Version).
+		Suffix(`
+			ON CONFLICT (worker_name, base_resource_type_id) DO UPDATE SET
+				version = EXCLUDED.version
+			RETURNING id
+		`).
+		RunWith(tx).
+		QueryRow().
+		Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UsedWorkerBaseResourceType{
+		ID:                 id,
+		WorkerName:         wbrt.WorkerName,
+		BaseResourceTypeID: wbrt.BaseResourceTypeID,
+		Version:            wbrt.Version,
+	}, nil
+}
+
+func (wbrt WorkerBaseResourceType) Find(runner sq.Runner) (*UsedWorkerBaseResourceType, bool, error) {
+	var id int
+	var version string
+	err := psql.Select("id, version").
+		From("worker_base_resource_types").
+		Where(sq.Eq{
+			"worker_name":           wbrt.WorkerName,
+			"base_resource_type_id": wbrt.BaseResourceTypeID,
+		}).
+		RunWith(runner).
+		QueryRow().
+		Scan(&id, &version)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, false, nil
+		}
+
+		return nil, false, err
+	}
+
+	return &UsedWorkerBaseResourceType{
+		ID:                 id,
+		WorkerName:         wbrt.WorkerName,
+		BaseResourceTypeID: wbrt.BaseResourceTypeID,
+		Version:            version,
+	}, true, nil
+}
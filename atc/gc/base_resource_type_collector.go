@@ -0,0 +1,58 @@
+package gc
+
+import (
+	"code.cloudfoundry.org/lager"
+
+	"github.com/concourse/concourse/atc/db"
+)
+
+// BaseResourceTypeCollector removes base resource types that have been
+// retired by an operator, once it's safe to do so: the type must be in the
+// retiring state, have no remaining worker_base_resource_types rows, AND
+// have no resource_configs row still referencing it (db.UsedBaseResourceType
+// documents this "use" as vicarious - so long as a ResourceConfig in use
+// references the type, it must not be removed). This gives pipelines a
+// window to migrate off a type before it disappears.
+type BaseResourceTypeCollector struct {
+	logger lager.Logger
+	conn   db.Conn
+}
+
+func NewBaseResourceTypeCollector(logger lager.Logger, conn db.Conn) *BaseResourceTypeCollector {
+	return &BaseResourceTypeCollector{
+		logger: logger,
+		conn:   conn,
+	}
+}
+
+func (brtc *BaseResourceTypeCollector) Run() error {
+	logger := brtc.logger.Session("base-resource-type-collector")
+
+	result, err := brtc.conn.Exec(`
+		DELETE FROM base_resource_types brt
+		WHERE brt.state = 'retiring'
+		AND NOT EXISTS (
+			SELECT 1 FROM worker_base_resource_types wbrt
+			WHERE wbrt.base_resource_type_id = brt.id
+		)
+		AND NOT EXISTS (
+			SELECT 1 FROM resource_configs rc
+			WHERE rc.base_resource_type_id = brt.id
+		)
+	`)
+	if err != nil {
+		logger.Error("failed-to-remove-retired-base-resource-types", err)
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected > 0 {
+		logger.Debug("removed-retired-base-resource-types", lager.Data{"rows": rowsAffected})
+	}
+
+	return nil
+}